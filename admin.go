@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AdminServer exposes an operator-facing HTTP API, separate from the
+// traffic-facing load balancer port: inspecting and mutating the pool at
+// runtime, triggering a config reload, and scraping Prometheus metrics.
+type AdminServer struct {
+	Pool       *NodePool
+	Reconciler *UpstreamReconciler
+	Reloader   *ConfigReloader
+	NewNode    func(UpstreamTarget) *Node
+	DrainFor   time.Duration
+}
+
+// Handler builds the admin mux
+func (a *AdminServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", a.handleNodes)
+	mux.HandleFunc("/nodes/", a.handleNode)
+	mux.HandleFunc("/reload", a.handleReload)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	return mux
+}
+
+type addNodeRequest struct {
+	URL    string  `json:"url"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+type patchNodeRequest struct {
+	Weight *float64 `json:"weight,omitempty"`
+	Active *bool    `json:"active,omitempty"`
+}
+
+func (a *AdminServer) handleNodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.Pool.NodeStates())
+	case http.MethodPost:
+		var req addNodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(req.URL)
+		if err != nil || u.Host == "" {
+			http.Error(w, "invalid url", http.StatusBadRequest)
+			return
+		}
+		weight := req.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		node := a.NewNode(UpstreamTarget{URL: u, Weight: weight})
+		nodes := a.Pool.AddNode(node)
+		if a.Reconciler != nil && a.Reconciler.OnChange != nil {
+			a.Reconciler.OnChange(nodes)
+		}
+		writeJSON(w, http.StatusCreated, nodeStateOf(node))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *AdminServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	id, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/nodes/"))
+	if err != nil || id == "" {
+		http.Error(w, "missing node id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		node, nodes, ok := a.Pool.RemoveNode(id)
+		if !ok {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		go drainNode(node, a.DrainFor)
+		if a.Reconciler != nil && a.Reconciler.OnChange != nil {
+			a.Reconciler.OnChange(nodes)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPatch:
+		node, ok := a.Pool.FindNode(id)
+		if !ok {
+			http.Error(w, "node not found", http.StatusNotFound)
+			return
+		}
+		var req patchNodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Weight != nil {
+			node.mutex.Lock()
+			node.weight = *req.Weight
+			node.mutex.Unlock()
+		}
+		if req.Active != nil {
+			node.SetProps(*req.Active)
+		}
+		writeJSON(w, http.StatusOK, nodeStateOf(node))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *AdminServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.Reloader == nil {
+		http.Error(w, "no config file configured", http.StatusNotImplemented)
+		return
+	}
+	if err := a.Reloader.Reload(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleMetrics renders Prometheus text exposition format. lb_request_duration_seconds
+// is exposed as a gauge of each node's latency EWMA rather than a true
+// histogram, since there's no metrics client library in this tree.
+func (a *AdminServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	nodes := a.Pool.snapshot()
+	sort.Slice(nodes, func(i, j int) bool { return nodeID(nodes[i]) < nodeID(nodes[j]) })
+
+	fmt.Fprintln(w, "# HELP lb_requests_total Total proxied requests per node and response code")
+	fmt.Fprintln(w, "# TYPE lb_requests_total counter")
+	for _, n := range nodes {
+		for code, count := range n.requestCounts() {
+			fmt.Fprintf(w, "lb_requests_total{node=%q,code=%q} %d\n", nodeID(n), fmt.Sprint(code), count)
+		}
+	}
+
+	fmt.Fprintln(w, "# HELP lb_request_duration_seconds Latency EWMA per node, in seconds")
+	fmt.Fprintln(w, "# TYPE lb_request_duration_seconds gauge")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "lb_request_duration_seconds{node=%q} %g\n", nodeID(n), n.getEWMA())
+	}
+
+	fmt.Fprintln(w, "# HELP lb_inflight In-flight requests per node")
+	fmt.Fprintln(w, "# TYPE lb_inflight gauge")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "lb_inflight{node=%q} %d\n", nodeID(n), n.inflightCount())
+	}
+
+	fmt.Fprintln(w, "# HELP lb_node_up Whether a node is currently active")
+	fmt.Fprintln(w, "# TYPE lb_node_up gauge")
+	for _, n := range nodes {
+		up := 0
+		if n.isActive() {
+			up = 1
+		}
+		fmt.Fprintf(w, "lb_node_up{node=%q} %d\n", nodeID(n), up)
+	}
+}
+
+func nodeStateOf(n *Node) NodeState {
+	return NodeState{
+		ID:        nodeID(n),
+		URL:       n.URL.String(),
+		Active:    n.isActive(),
+		Weight:    n.getWeight(),
+		Inflight:  n.inflightCount(),
+		EWMA:      n.getEWMA(),
+		LastCheck: n.getLastCheck(),
+	}
+}
+
+// drainNode marks a removed node inactive and waits (bounded by drainFor)
+// for its in-flight requests to finish before releasing its connections
+func drainNode(n *Node, drainFor time.Duration) {
+	n.SetProps(false)
+
+	deadline := time.Now().Add(drainFor)
+	for n.inflightCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	rt := n.ReverseProxy.Transport
+	if trt, ok := rt.(*timingRoundTripper); ok {
+		rt = trt.rt
+	}
+	if t, ok := rt.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
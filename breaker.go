@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned by timingRoundTripper when a node's breaker
+// rejects the request outright: it's open and still cooling down, or
+// already has a half-open probe in flight.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerConfig configures a per-node circuit breaker
+type CircuitBreakerConfig struct {
+	Window               time.Duration // sliding window over which the failure rate is measured
+	MinRequests          int           // requests required in Window before the rate is evaluated
+	FailureRateThreshold float64       // e.g. 0.5 trips the breaker at 50% failures
+	Cooldown             time.Duration // time spent open before a single probe is admitted
+}
+
+type cbState int
+
+const (
+	cbClosed cbState = iota
+	cbOpen
+	cbHalfOpen
+)
+
+type cbEvent struct {
+	at     time.Time
+	failed bool
+}
+
+// CircuitBreaker is a closed/open/half-open breaker guarding one node: it
+// trips open once Config.FailureRateThreshold is reached over Window,
+// short-circuits new requests while open, then admits a single half-open
+// probe after Cooldown to decide whether to close again.
+type CircuitBreaker struct {
+	Config CircuitBreakerConfig
+
+	mutex    sync.Mutex
+	state    cbState
+	openedAt time.Time
+	events   []cbEvent
+}
+
+// NewCircuitBreaker builds a closed breaker from cfg
+func NewCircuitBreaker(cfg CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{Config: cfg}
+}
+
+// Eligible reports whether a request may currently be routed to the node
+// this breaker guards, without claiming the half-open probe slot.
+func (cb *CircuitBreaker) Eligible() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case cbClosed:
+		return true
+	case cbOpen:
+		return time.Since(cb.openedAt) >= cb.Config.Cooldown
+	default: // cbHalfOpen: a probe is already in flight
+		return false
+	}
+}
+
+// Claim reports whether the caller may actually send its request, atomically
+// claiming the single half-open probe slot if this is the request that wins
+// it. Call once, immediately before actually routing a request to the node;
+// a false return means the caller must not proceed (short-circuit instead).
+func (cb *CircuitBreaker) Claim() bool {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	switch cb.state {
+	case cbClosed:
+		return true
+	case cbOpen:
+		if time.Since(cb.openedAt) < cb.Config.Cooldown {
+			return false
+		}
+		cb.state = cbHalfOpen
+		return true
+	default: // cbHalfOpen: a probe is already in flight
+		return false
+	}
+}
+
+// Record folds the outcome of a completed request into the breaker,
+// tripping it open if the failure rate over Window crosses the threshold,
+// or resolving a half-open probe back to closed/open.
+func (cb *CircuitBreaker) Record(failed bool) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	now := time.Now()
+	if cb.state == cbHalfOpen {
+		if failed {
+			cb.state = cbOpen
+			cb.openedAt = now
+		} else {
+			cb.state = cbClosed
+		}
+		cb.events = nil
+		return
+	}
+
+	cutoff := now.Add(-cb.Config.Window)
+	kept := cb.events[:0]
+	for _, e := range cb.events {
+		if e.at.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	cb.events = append(kept, cbEvent{at: now, failed: failed})
+
+	if len(cb.events) < cb.Config.MinRequests {
+		return
+	}
+	var failures int
+	for _, e := range cb.events {
+		if e.failed {
+			failures++
+		}
+	}
+	if float64(failures)/float64(len(cb.events)) >= cb.Config.FailureRateThreshold {
+		cb.state = cbOpen
+		cb.openedAt = now
+	}
+}
+
+// RetryBudget caps retries to a fraction of recent successful requests, a
+// la gRPC's retry throttling: every success deposits Ratio tokens (up to
+// Max), and every retry spends one, so a failing cluster can't be
+// hammered by blind retries.
+type RetryBudget struct {
+	Ratio float64
+	Max   float64
+
+	mutex  sync.Mutex
+	tokens float64
+}
+
+// NewRetryBudget builds a budget that starts fully funded
+func NewRetryBudget(ratio, max float64) *RetryBudget {
+	return &RetryBudget{Ratio: ratio, Max: max, tokens: max}
+}
+
+// OnSuccess deposits Ratio tokens, capped at Max
+func (b *RetryBudget) OnSuccess() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += b.Ratio
+	if b.tokens > b.Max {
+		b.tokens = b.Max
+	}
+}
+
+// TryRetry spends one token if available and reports whether it did
+func (b *RetryBudget) TryRetry() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
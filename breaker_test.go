@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		Window:               time.Minute,
+		MinRequests:          2,
+		FailureRateThreshold: 0.5,
+		Cooldown:             20 * time.Millisecond,
+	}
+}
+
+func TestCircuitBreaker_TripsOpenOnFailureRate(t *testing.T) {
+	cb := NewCircuitBreaker(testBreakerConfig())
+
+	if !cb.Claim() {
+		t.Fatalf("closed breaker should claim every request")
+	}
+	cb.Record(true)
+	if !cb.Eligible() {
+		t.Fatalf("should still be eligible below MinRequests")
+	}
+
+	if !cb.Claim() {
+		t.Fatalf("closed breaker should still claim")
+	}
+	cb.Record(true)
+
+	if cb.Eligible() {
+		t.Fatalf("2/2 failures should trip the breaker open")
+	}
+	if cb.Claim() {
+		t.Fatalf("an open breaker within its cooldown must not be claimable")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenAfterCooldown(t *testing.T) {
+	cfg := testBreakerConfig()
+	cfg.Cooldown = 10 * time.Millisecond
+	cb := NewCircuitBreaker(cfg)
+
+	cb.Claim()
+	cb.Record(true)
+	cb.Claim()
+	cb.Record(true) // trips open
+
+	time.Sleep(cfg.Cooldown + 5*time.Millisecond)
+
+	if !cb.Eligible() {
+		t.Fatalf("should be eligible for a probe once cooldown elapses")
+	}
+	if !cb.Claim() {
+		t.Fatalf("first caller after cooldown should win the probe slot")
+	}
+	if cb.Claim() {
+		t.Fatalf("a second concurrent caller must not also win the probe slot")
+	}
+	if cb.Eligible() {
+		t.Fatalf("a node with a probe in flight should not look eligible to other callers")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenSuccessCloses(t *testing.T) {
+	cfg := testBreakerConfig()
+	cfg.Cooldown = 10 * time.Millisecond
+	cb := NewCircuitBreaker(cfg)
+
+	cb.Claim()
+	cb.Record(true)
+	cb.Claim()
+	cb.Record(true) // trips open
+
+	time.Sleep(cfg.Cooldown + 5*time.Millisecond)
+	if !cb.Claim() {
+		t.Fatalf("expected to win the probe slot")
+	}
+	cb.Record(false)
+
+	if !cb.Eligible() || !cb.Claim() {
+		t.Fatalf("a successful probe should close the breaker")
+	}
+}
+
+func TestCircuitBreaker_HalfOpenFailureReopens(t *testing.T) {
+	cfg := testBreakerConfig()
+	cfg.Cooldown = 10 * time.Millisecond
+	cb := NewCircuitBreaker(cfg)
+
+	cb.Claim()
+	cb.Record(true)
+	cb.Claim()
+	cb.Record(true) // trips open
+
+	time.Sleep(cfg.Cooldown + 5*time.Millisecond)
+	if !cb.Claim() {
+		t.Fatalf("expected to win the probe slot")
+	}
+	cb.Record(true) // failed probe
+
+	if cb.Eligible() {
+		t.Fatalf("a failed probe should reopen the breaker, not close it")
+	}
+	if cb.Claim() {
+		t.Fatalf("should not be claimable again until a fresh cooldown elapses")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"time"
+)
+
+// FileConfig is the on-disk, hot-reloadable subset of the load balancer's
+// configuration: upstreams and the selection policy. CLI flags remain the
+// source of truth for everything that can't safely change at runtime
+// (ports, health checks, etc).
+type FileConfig struct {
+	Policy string           `json:"policy,omitempty"`
+	Nodes  []FileConfigNode `json:"nodes,omitempty"`
+}
+
+// FileConfigNode is one static upstream entry in a FileConfig
+type FileConfigNode struct {
+	URL    string  `json:"url"`
+	Weight float64 `json:"weight,omitempty"`
+}
+
+// LoadFileConfig reads and parses a FileConfig from path
+func LoadFileConfig(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg FileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// Targets converts the file config's nodes into UpstreamTargets
+func (c *FileConfig) Targets() ([]UpstreamTarget, error) {
+	targets := make([]UpstreamTarget, 0, len(c.Nodes))
+	for _, n := range c.Nodes {
+		u, err := url.Parse(n.URL)
+		if err != nil {
+			return nil, err
+		}
+		weight := n.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		targets = append(targets, UpstreamTarget{URL: u, Weight: weight})
+	}
+	return targets, nil
+}
+
+// ConfigReloader applies a freshly loaded FileConfig to the running pool
+type ConfigReloader struct {
+	Path       string
+	Pool       *NodePool
+	Reconciler *UpstreamReconciler
+}
+
+// Reload re-reads Path and applies its policy/nodes to the pool
+func (r *ConfigReloader) Reload() error {
+	cfg, err := LoadFileConfig(r.Path)
+	if err != nil {
+		return err
+	}
+
+	if cfg.Policy != "" {
+		policy, err := NewSelectionPolicy(cfg.Policy)
+		if err != nil {
+			return err
+		}
+		r.Pool.SetPolicy(policy)
+	}
+
+	if len(cfg.Nodes) > 0 {
+		targets, err := cfg.Targets()
+		if err != nil {
+			return err
+		}
+		r.Reconciler.ReconcileTargets(targets)
+	}
+
+	log.Printf("config: reloaded from %s", r.Path)
+	return nil
+}
+
+// WatchConfigFile polls path's modification time every interval and calls
+// reload whenever it changes, until stop is closed. There is no fsnotify
+// (or any third-party) dependency available in this tree, so the watch is
+// a plain stat-and-compare loop rather than an inotify/kqueue one.
+func WatchConfigFile(path string, interval time.Duration, reload func() error, stop <-chan struct{}) {
+	var lastMod time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastMod = info.ModTime()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			if info.ModTime().Equal(lastMod) {
+				continue
+			}
+			lastMod = info.ModTime()
+			if err := reload(); err != nil {
+				log.Printf("config: reload failed: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ActiveHealthCheckConfig configures the periodic HTTP probe run against
+// every node.
+type ActiveHealthCheckConfig struct {
+	Path               string
+	Interval           time.Duration
+	Timeout            time.Duration
+	ExpectedStatus     string // e.g. "2xx", "200", or "200,301"
+	ExpectedBody       string // regex matched against the response body, optional
+	UnhealthyThreshold int
+	HealthyThreshold   int
+}
+
+// matchesStatus reports whether code satisfies the configured expected
+// status, which may be a literal code ("200") or a pattern ("2xx")
+func (c ActiveHealthCheckConfig) matchesStatus(code int) bool {
+	if c.ExpectedStatus == "" {
+		return code >= 200 && code < 300
+	}
+	for _, want := range strings.Split(c.ExpectedStatus, ",") {
+		want = strings.TrimSpace(want)
+		if strings.HasSuffix(want, "xx") && len(want) == 3 {
+			if digit, err := strconv.Atoi(want[:1]); err == nil && code/100 == digit {
+				return true
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(want); err == nil && n == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ActiveHealthChecker periodically probes every node over HTTP and flips
+// their status after consecutive_threshold failures/successes
+type ActiveHealthChecker struct {
+	Config ActiveHealthCheckConfig
+	client *http.Client
+	body   *regexp.Regexp
+}
+
+// NewActiveHealthChecker builds a checker from the given config
+func NewActiveHealthChecker(cfg ActiveHealthCheckConfig) (*ActiveHealthChecker, error) {
+	var body *regexp.Regexp
+	if cfg.ExpectedBody != "" {
+		var err error
+		body, err = regexp.Compile(cfg.ExpectedBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ActiveHealthChecker{
+		Config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		body:   body,
+	}, nil
+}
+
+// Run probes every node in the pool on Config.Interval until stopped
+func (c *ActiveHealthChecker) Run(np *NodePool, stop <-chan struct{}) {
+	t := time.NewTicker(c.Config.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			for _, n := range np.snapshot() {
+				c.probe(n)
+			}
+		}
+	}
+}
+
+// probe issues a single HTTP health check against n and records the result,
+// skipping nodes still inside a passive-check cooldown
+func (c *ActiveHealthChecker) probe(n *Node) {
+	n.mutex.RLock()
+	cooling := time.Now().Before(n.cooldownUntil)
+	n.mutex.RUnlock()
+	if cooling {
+		return
+	}
+	ok := c.check(n)
+	n.recordActiveCheck(ok, c.Config.HealthyThreshold, c.Config.UnhealthyThreshold)
+}
+
+func (c *ActiveHealthChecker) check(n *Node) bool {
+	target := strings.TrimRight(n.URL.String(), "/") + c.Config.Path
+	resp, err := c.client.Get(target)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if !c.Config.matchesStatus(resp.StatusCode) {
+		return false
+	}
+	if c.body != nil {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if err != nil {
+			return false
+		}
+		if !c.body.Match(body) {
+			return false
+		}
+	}
+	return true
+}
+
+// PassiveHealthCheckConfig configures the sliding-window failure/latency
+// detector fed by live proxy traffic.
+type PassiveHealthCheckConfig struct {
+	Window                time.Duration
+	FailureThreshold      int
+	LatencyThreshold      time.Duration
+	LatencyCountThreshold int // over-threshold samples in Window needed to trip; defaults to 1 if unset
+	Cooldown              time.Duration
+}
+
+// passiveConfig is the process-wide passive health check configuration,
+// set from CLI flags in main
+var passiveConfig PassiveHealthCheckConfig
+
+type passiveEvent struct {
+	at      time.Time
+	failed  bool
+	latency time.Duration
+}
+
+// passiveWindow tracks recent request outcomes for one node
+type passiveWindow struct {
+	mutex  sync.Mutex
+	events []passiveEvent
+}
+
+// record appends an outcome, prunes events older than window, and reports
+// whether the node should be tripped unhealthy
+func (w *passiveWindow) record(ev passiveEvent, cfg PassiveHealthCheckConfig) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	cutoff := ev.at.Add(-cfg.Window)
+	kept := w.events[:0]
+	for _, e := range w.events {
+		if e.at.After(cutoff) {
+			kept = append(kept, e)
+		}
+	}
+	w.events = append(kept, ev)
+
+	var failures int
+	var over int
+	for _, e := range w.events {
+		if e.failed {
+			failures++
+		}
+		if cfg.LatencyThreshold > 0 && e.latency > cfg.LatencyThreshold {
+			over++
+		}
+	}
+	return (cfg.FailureThreshold > 0 && failures >= cfg.FailureThreshold) ||
+		(cfg.LatencyThreshold > 0 && over >= max(cfg.LatencyCountThreshold, 1))
+}
+
+// RecordOutcome feeds a proxied request's outcome into n's passive window,
+// tripping it unhealthy (with a re-probe after Cooldown) if it crosses
+// the configured thresholds.
+func (n *Node) RecordOutcome(failed bool, latency time.Duration, cfg PassiveHealthCheckConfig) {
+	if n.passive == nil || (cfg.FailureThreshold <= 0 && cfg.LatencyThreshold <= 0) {
+		return
+	}
+	if n.passive.record(passiveEvent{at: time.Now(), failed: failed, latency: latency}, cfg) {
+		n.SetProps(false)
+		n.scheduleCooldown(cfg.Cooldown)
+	}
+}
+
+// NodeState is the JSON-serializable snapshot of a node exposed on /lb/health
+type NodeState struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Active    bool      `json:"active"`
+	Weight    float64   `json:"weight"`
+	Inflight  int64     `json:"inflight"`
+	EWMA      float64   `json:"ewma_seconds"`
+	LastCheck time.Time `json:"last_check"`
+}
+
+// NodeStates returns a snapshot of every node in the pool for /lb/health
+func (np *NodePool) NodeStates() []NodeState {
+	nodes := np.snapshot()
+	states := make([]NodeState, 0, len(nodes))
+	for _, n := range nodes {
+		states = append(states, NodeState{
+			ID:        nodeID(n),
+			URL:       n.URL.String(),
+			Active:    n.isActive(),
+			Weight:    n.getWeight(),
+			Inflight:  n.inflightCount(),
+			EWMA:      n.getEWMA(),
+			LastCheck: n.getLastCheck(),
+		})
+	}
+	return states
+}
+
+// HealthHandler serves JSON node state on the LB's own /lb/health endpoint
+func HealthHandler(np *NodePool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(np.NodeStates())
+	}
+}
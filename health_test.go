@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPassiveWindow_TripsOnFailureThreshold(t *testing.T) {
+	cfg := PassiveHealthCheckConfig{Window: time.Minute, FailureThreshold: 2}
+	w := &passiveWindow{}
+
+	now := time.Now()
+	if w.record(passiveEvent{at: now, failed: true}, cfg) {
+		t.Fatalf("a single failure below FailureThreshold should not trip")
+	}
+	if !w.record(passiveEvent{at: now, failed: true}, cfg) {
+		t.Fatalf("2 failures at FailureThreshold=2 should trip")
+	}
+}
+
+func TestPassiveWindow_PrunesEventsOutsideWindow(t *testing.T) {
+	cfg := PassiveHealthCheckConfig{Window: time.Second, FailureThreshold: 2}
+	w := &passiveWindow{}
+
+	base := time.Now()
+	w.record(passiveEvent{at: base, failed: true}, cfg)
+
+	// Second failure arrives after the first has aged out of the window, so
+	// only one failure is ever in view at once and it should never trip.
+	if w.record(passiveEvent{at: base.Add(2 * time.Second), failed: true}, cfg) {
+		t.Fatalf("a failure outside the window must be pruned, not counted")
+	}
+}
+
+func TestPassiveWindow_LatencyOnlyThreshold(t *testing.T) {
+	cfg := PassiveHealthCheckConfig{Window: time.Minute, LatencyThreshold: 100 * time.Millisecond}
+	w := &passiveWindow{}
+
+	now := time.Now()
+	if w.record(passiveEvent{at: now, failed: false, latency: 50 * time.Millisecond}, cfg) {
+		t.Fatalf("latency under the threshold should not trip")
+	}
+	if !w.record(passiveEvent{at: now, failed: false, latency: 200 * time.Millisecond}, cfg) {
+		t.Fatalf("a latency-only config with no FailureThreshold should still trip on one slow request")
+	}
+}
+
+func TestPassiveWindow_NoThresholdsNeverTrips(t *testing.T) {
+	cfg := PassiveHealthCheckConfig{Window: time.Minute}
+	w := &passiveWindow{}
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if w.record(passiveEvent{at: now, failed: true, latency: time.Hour}, cfg) {
+			t.Fatalf("a config with no thresholds configured should never trip")
+		}
+	}
+}
+
+func TestRecordOutcome_LatencyOnlyConfigTrips(t *testing.T) {
+	n := newTestNode("a")
+	n.passive = &passiveWindow{}
+	cfg := PassiveHealthCheckConfig{Window: time.Minute, LatencyThreshold: 10 * time.Millisecond, Cooldown: time.Minute}
+
+	n.RecordOutcome(false, 50*time.Millisecond, cfg)
+
+	if n.isActive() {
+		t.Fatalf("RecordOutcome must act on LatencyThreshold alone, even with FailureThreshold left at its zero default")
+	}
+}
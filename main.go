@@ -10,119 +10,11 @@ import (
 	"net/http/httputil"
 	"net/url"
 	"strings"
-	"sync"
 	"sync/atomic"
 	"time"
 )
 
-const (
-	Attempts int = iota // Unique keys
-	Retry
-)
-
-// Node holds the data about a backend server
-type Node struct {
-	URL          *url.URL
-	Active       bool
-	weight	     float64
-	mutex        sync.RWMutex
-	ReverseProxy *httputil.ReverseProxy
-}
-
-// NodePool holds slice of nodes and most recently used node index
-type NodePool struct {
-	nodes   []*Node
-	current uint64
-}
-
-// AddNode new node to NodePool
-func (np *NodePool) AddNode(n *Node) {
-	np.nodes = append(np.nodes, n)
-}
-
-// NextIdx atomically increase the counter and return an index
-func (np *NodePool) NextIdx() int {
-	return int(atomic.AddUint64(&np.current, uint64(1)) % uint64(len(np.nodes)))
-}
-
-// isActive returns whether node is active or dead
-func (n *Node) isActive() bool {
-	var active bool
-	n.mutex.RLock()
-	active = n.Active
-	n.mutex.RUnlock()
-	return active
-}
-
-// getWeight returns the weight of the node
-func (n *Node) getWeight() float64 {
-	n.mutex.RLock()
-	weight := n.weight
-	n.mutex.RUnlock()
-	return weight
-}
-
-//Swap two elements in nodePool
-func (np *NodePool) Swap(i uint64, j uint64) {
-	temp := np.nodes[i]
-	np.nodes[i] = np.nodes[j]
-	np.nodes[j] = temp
-}
-
-// Heapify will rearrange the max heap based on weights, takes index and if the node is root
-func (np *NodePool) Heapify(idx uint64, root bool) {
-	largest := idx
-	left := 2*idx + 1
-	right := 2*idx + 2
-
-	if root {
-		np.nodes[idx].weight /= 2
-	}
-
-	if left < uint64(len(np.nodes)) && np.nodes[left].isActive() && np.nodes[left].getWeight() > np.nodes[largest].getWeight() {
-		largest = left
-	}
-	
-	if right < uint64(len(np.nodes)) && np.nodes[right].isActive() && np.nodes[right].getWeight() > np.nodes[largest].getWeight() {
-		largest = right
-	}
-
-	if largest != idx {
-		if root {
-			np.nodes[idx].weight *= 2
-		}
-
-		np.Swap(largest, idx)
-		np.Heapify(largest, false)
-	}
-
-	if left < uint64(len(np.nodes)) && np.nodes[left].getWeight() < 1 {
-		np.Heapify(left, false)
-	}
-
-	if right < uint64(len(np.nodes)) && np.nodes[right].getWeight() < 1 {
-		np.Heapify(right, false)
-	}
-
-}
-
-// NextNode find next active node
-func (np *NodePool) NextNode() *Node {
-	//// Round Robin algorithm
-	//next := np.NextIdx()
-	//for i := next; i < len(np.nodes)+next; i++ {
-		//idx := i % len(np.nodes)
-		//if np.nodes[idx].isActive() {
-			//atomic.StoreUint64(&np.current, uint64(idx))
-			//return np.nodes[idx]
-		//}
-	//}
-	//return nil
-
-	//Using heapify to select node
-	return np.nodes[0]
-
-}
+const Attempts int = iota // Unique context key
 
 // Balance incoming requests
 func loadBalancer(w http.ResponseWriter, r *http.Request) {
@@ -132,157 +24,361 @@ func loadBalancer(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Service not available", http.StatusServiceUnavailable)
 		return
 	}
-	node := nodePool.NextNode()
+	var node *Node
+	if stickyRouter != nil {
+		node = stickyRouter.Route(r)
+	}
+	if node == nil {
+		node = nodePool.NextNode()
+	}
 	if node != nil {
+		atomic.AddInt64(&node.inflight, 1)
 		node.ReverseProxy.ServeHTTP(w, r)
-		nodePool.Heapify(0, true)
+		atomic.AddInt64(&node.inflight, -1)
 		return
 	}
 	// 0 active nodes available
 	http.Error(w, "Downtime: No nodes available", http.StatusServiceUnavailable)
 }
 
-// Status check node status by establishing TCP connection
-func (n *Node) Status() bool {
-	conn, err := net.DialTimeout("tcp", n.URL.Host, 2*time.Second)
-	if err != nil {
-		log.Println("Node unreachable: ", err)
-		return false
+// GetAttemptsFromContext returns the attempts for request
+func GetAttemptsFromContext(r *http.Request) int {
+	if attempts, ok := r.Context().Value(Attempts).(int); ok {
+		return attempts
 	}
-	_ = conn.Close()
-	return true
+	return 1
 }
 
-// SetProps sets node's status and changes node's weight
-func (n *Node) SetProps(status bool) {
-	n.mutex.Lock()
-	n.Active = status
-	if !status {
-		n.weight /= 3.0;
-	} else if n.weight < 1 {
-		n.weight *= 2.0; 
-	} 
-	n.mutex.Unlock()
+// isRetryableRequest reports whether r may be safely retried against a
+// different node: idempotent methods always are, others only carry an
+// explicit X-Idempotency-Key so a client-side-only POST doesn't silently
+// run twice.
+func isRetryableRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return r.Header.Get("X-Idempotency-Key") != ""
+	}
 }
 
+var nodePool NodePool
 
-// HealthCheck pings the node and update status
-func (np *NodePool) HealthCheck() {
-	for i, n := range np.nodes {
-		status := n.Status()
-		n.SetProps(status)
-		msg := "active"
-		if !status {
-			msg = "dead"
-			np.Heapify(uint64(i), false)
-		}
-		log.Printf("%s [%s] [%0.2g]\n", n.URL, msg, n.weight)
-	}
+// stickyRouter is non-nil when -sticky is set, and consulted by
+// loadBalancer before falling back to the pool's selection policy
+var stickyRouter *StickyRouter
+
+// retryBudget bounds how many of the retries attempted across all nodes
+// may proceed, as a fraction of recently successful requests
+var retryBudget *RetryBudget
+
+// circuitBreakerConfig is applied to every node's CircuitBreaker; zeroed
+// out (Window == 0) disables circuit breaking entirely
+var circuitBreakerConfig CircuitBreakerConfig
+
+// transportConfig tunes the per-node *http.Transport
+type transportConfig struct {
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
 }
 
-// SetNodeStatus sets status of the given nodeURL
-func (np *NodePool) SetNodeStatus(url *url.URL, status bool) {
-	for _, n := range np.nodes {
-		if n.URL.String() == url.String() {
-			n.SetProps(status)
-			break
-		}
-	}
-}
+var perNodeTransport transportConfig
 
-// GetAttemptsFromContext returns the attempts for request
-func GetAttemptsFromContext(r *http.Request) int {
-	if attempts, ok := r.Context().Value(Attempts).(int); ok {
-		return attempts
+// buildNode wires up a Node for the given backend target: its own
+// *http.Transport and circuit breaker, the timing RoundTripper used for
+// EWMA/passive/breaker bookkeeping, and the retry ErrorHandler. Used both
+// for nodes configured at startup and for ones discovered later by an
+// UpstreamReconciler.
+func buildNode(target UpstreamTarget) *Node {
+	nodeURL := target.URL
+	proxy := httputil.NewSingleHostReverseProxy(nodeURL)
+
+	var breaker *CircuitBreaker
+	if circuitBreakerConfig.Window > 0 {
+		breaker = NewCircuitBreaker(circuitBreakerConfig)
 	}
-	return 1
-}
 
-// GetRetryFromContext returns the retry for request
-func GetRetryFromContext(r *http.Request) int {
-	if retry, ok := r.Context().Value(Retry).(int); ok {
-		return retry
+	node := &Node{
+		URL:          nodeURL,
+		Active:       true,
+		weight:       target.Weight,
+		ReverseProxy: proxy,
+		passive:      &passiveWindow{},
+		breaker:      breaker,
 	}
-	return 0
-}
 
-// Check health of nodes periodically
-func healthCheck() {
-	t := time.NewTicker(time.Minute * 2)
-	for {
-		select {
-		case <-t.C:
-			log.Printf("Starting health check...")
-			nodePool.HealthCheck()
+	transport := &http.Transport{
+		MaxIdleConnsPerHost:   perNodeTransport.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       perNodeTransport.MaxConnsPerHost,
+		IdleConnTimeout:       perNodeTransport.IdleConnTimeout,
+		ResponseHeaderTimeout: perNodeTransport.ResponseHeaderTimeout,
+		DialContext: (&net.Dialer{
+			Timeout: perNodeTransport.DialTimeout,
+		}).DialContext,
+	}
+	proxy.Transport = &timingRoundTripper{node: node, rt: transport}
+	if stickyRouter != nil {
+		proxy.ModifyResponse = stickyRouter.TagResponse(node)
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, request *http.Request, e error) {
+		log.Printf("[%s] %s\n", nodeURL.Host, e.Error())
 
+		attempts := GetAttemptsFromContext(request)
+		if attempts >= 3 {
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
 		}
+		if !isRetryableRequest(request) {
+			http.Error(w, "Upstream error", http.StatusBadGateway)
+			return
+		}
+		if retryBudget != nil && !retryBudget.TryRetry() {
+			log.Printf("%s(%s) retry budget exhausted\n", request.RemoteAddr, request.URL.Path)
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		log.Printf("%s(%s) retrying on a different node, attempt %d\n", request.RemoteAddr, request.URL.Path, attempts+1)
+		ctx := context.WithValue(request.Context(), Attempts, attempts+1)
+		loadBalancer(w, request.WithContext(ctx))
 	}
+	log.Printf("Configured node: %s\n", nodeURL)
+	return node
 }
 
-var nodePool NodePool
+// buildUpstreamSource constructs the UpstreamSource selected by -upstreamSource
+func buildUpstreamSource(kind, nodeList, dnsName string, dnsPort int, srvService, srvProto, srvName string) (UpstreamSource, error) {
+	switch kind {
+	case "static", "":
+		if len(nodeList) == 0 {
+			return nil, fmt.Errorf("-nodeList is required for the static upstream source")
+		}
+		targets := make([]UpstreamTarget, 0)
+		for _, raw := range strings.Split(nodeList, ",") {
+			u, err := url.Parse(raw)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, UpstreamTarget{URL: u, Weight: 1})
+		}
+		return &StaticSource{Targets: targets}, nil
+	case "dns":
+		if dnsName == "" {
+			return nil, fmt.Errorf("-dnsName is required for the dns upstream source")
+		}
+		return &DNSSource{Host: dnsName, Port: dnsPort, Scheme: "http"}, nil
+	case "srv":
+		if srvName == "" {
+			return nil, fmt.Errorf("-srvName is required for the srv upstream source")
+		}
+		return &SRVSource{Service: srvService, Proto: srvProto, Domain: srvName, Scheme: "http"}, nil
+	default:
+		return nil, fmt.Errorf("unknown upstream source: %q", kind)
+	}
+}
 
 func main() {
 	var nodeList string
 	var port int
-	flag.StringVar(&nodeList, "nodeList", "", "List of avaiable nodes comma-separated")
+	var policyName string
+	var halfLife time.Duration
+	var healthPath string
+	var healthInterval time.Duration
+	var healthTimeout time.Duration
+	var expectedStatus string
+	var expectedBody string
+	var healthyThreshold int
+	var unhealthyThreshold int
+	var passiveWindowFlag time.Duration
+	var passiveFailures int
+	var passiveLatency time.Duration
+	var passiveLatencyCount int
+	var passiveCooldown time.Duration
+	var upstreamSource string
+	var upstreamRefresh time.Duration
+	var drainTimeout time.Duration
+	var dnsName string
+	var dnsPort int
+	var srvService string
+	var srvProto string
+	var srvName string
+	var stickyMode string
+	var stickyCookieName string
+	var stickySecret string
+	var stickyVNodes int
+	var maxIdleConnsPerHost int
+	var maxConnsPerHost int
+	var idleConnTimeout time.Duration
+	var dialTimeout time.Duration
+	var responseHeaderTimeout time.Duration
+	var breakerWindow time.Duration
+	var breakerMinRequests int
+	var breakerFailureRate float64
+	var breakerCooldown time.Duration
+	var retryBudgetRatio float64
+	var retryBudgetMax float64
+	var adminPort int
+	var configPath string
+	var configPollInterval time.Duration
+	flag.StringVar(&nodeList, "nodeList", "", "List of avaiable nodes comma-separated (used by the static upstream source)")
 	flag.IntVar(&port, "port", 3030, "Port to serve load-balancer")
+	flag.StringVar(&policyName, "policy", "round_robin", "Selection policy: round_robin, weighted_rr, least_conn, peak_ewma, random_two")
+	flag.DurationVar(&halfLife, "ewmaHalfLife", 10*time.Second, "Half-life for the peak_ewma/random_two latency average")
+	flag.StringVar(&healthPath, "healthPath", "/", "Path to probe for active HTTP health checks")
+	flag.DurationVar(&healthInterval, "healthInterval", 10*time.Second, "Interval between active health checks")
+	flag.DurationVar(&healthTimeout, "healthTimeout", 2*time.Second, "Timeout for each active health check request")
+	flag.StringVar(&expectedStatus, "healthExpectedStatus", "2xx", "Expected status code/pattern for active health checks, e.g. 2xx")
+	flag.StringVar(&expectedBody, "healthExpectedBody", "", "Optional regex the health check response body must match")
+	flag.IntVar(&healthyThreshold, "healthyThreshold", 2, "Consecutive successful active checks before a node is marked healthy")
+	flag.IntVar(&unhealthyThreshold, "unhealthyThreshold", 3, "Consecutive failed active checks before a node is marked unhealthy")
+	flag.DurationVar(&passiveWindowFlag, "passiveWindow", 10*time.Second, "Sliding window over which passive failures are counted")
+	flag.IntVar(&passiveFailures, "passiveFailureThreshold", 0, "Proxy failures within passiveWindow before a node is tripped unhealthy (0 disables failure-count tripping)")
+	flag.DurationVar(&passiveLatency, "passiveLatencyThreshold", 0, "Latency within passiveWindow before a node is tripped unhealthy (0 disables)")
+	flag.IntVar(&passiveLatencyCount, "passiveLatencyCountThreshold", 1, "Over-threshold samples within passiveWindow required to trip on latency, independent of passiveFailureThreshold")
+	flag.DurationVar(&passiveCooldown, "passiveCooldown", 30*time.Second, "Cooldown before a passively-tripped node is re-probed")
+	flag.StringVar(&upstreamSource, "upstreamSource", "static", "Upstream discovery source: static, dns, srv")
+	flag.DurationVar(&upstreamRefresh, "upstreamRefresh", 30*time.Second, "Interval between upstream re-resolves for the dns/srv sources")
+	flag.DurationVar(&drainTimeout, "drainTimeout", 30*time.Second, "How long a removed node is given to finish in-flight requests")
+	flag.StringVar(&dnsName, "dnsName", "", "Hostname to resolve for the dns upstream source")
+	flag.IntVar(&dnsPort, "dnsPort", 80, "Port to pair with addresses resolved by the dns upstream source")
+	flag.StringVar(&srvService, "srvService", "http", "Service name for the srv upstream source, e.g. http in _http._tcp.example.com")
+	flag.StringVar(&srvProto, "srvProto", "tcp", "Protocol for the srv upstream source")
+	flag.StringVar(&srvName, "srvName", "", "Domain name for the srv upstream source, e.g. example.com")
+	flag.StringVar(&stickyMode, "sticky", "", "Session affinity mode: cookie, ip_hash (default: none)")
+	flag.StringVar(&stickyCookieName, "stickyCookieName", "LB_NODE", "Cookie name used by -sticky=cookie")
+	flag.StringVar(&stickySecret, "stickySecret", "", "HMAC secret used to sign the sticky cookie, required for -sticky=cookie")
+	flag.IntVar(&stickyVNodes, "stickyVNodes", 160, "Virtual nodes per backend on the -sticky=ip_hash ring")
+	flag.IntVar(&maxIdleConnsPerHost, "maxIdleConnsPerHost", 10, "Per-node max idle connections kept alive")
+	flag.IntVar(&maxConnsPerHost, "maxConnsPerHost", 0, "Per-node max concurrent connections, 0 for unlimited")
+	flag.DurationVar(&idleConnTimeout, "idleConnTimeout", 90*time.Second, "Per-node idle connection timeout")
+	flag.DurationVar(&dialTimeout, "dialTimeout", 5*time.Second, "Per-node dial timeout")
+	flag.DurationVar(&responseHeaderTimeout, "responseHeaderTimeout", 0, "Per-node timeout waiting for response headers, 0 for no timeout")
+	flag.DurationVar(&breakerWindow, "breakerWindow", 0, "Sliding window for the per-node circuit breaker's failure rate, 0 disables it")
+	flag.IntVar(&breakerMinRequests, "breakerMinRequests", 10, "Requests required in breakerWindow before the failure rate is evaluated")
+	flag.Float64Var(&breakerFailureRate, "breakerFailureRate", 0.5, "Failure rate that trips the circuit breaker open")
+	flag.DurationVar(&breakerCooldown, "breakerCooldown", 30*time.Second, "How long the circuit breaker stays open before a probe request")
+	flag.Float64Var(&retryBudgetRatio, "retryBudgetRatio", 0.1, "Retry tokens deposited per successful request")
+	flag.Float64Var(&retryBudgetMax, "retryBudgetMax", 10, "Maximum banked retry tokens")
+	flag.IntVar(&adminPort, "adminPort", 0, "Port for the admin API (/nodes, /reload, /metrics), 0 disables it")
+	flag.StringVar(&configPath, "config", "", "Path to a JSON config file for hot-reloadable policy/nodes")
+	flag.DurationVar(&configPollInterval, "configPollInterval", 2*time.Second, "How often the config file is checked for changes")
 	flag.Parse()
 
-	if len(nodeList) == 0 {
-		log.Fatal("Please provide one or more nodes to load balance")
+	policy, err := NewSelectionPolicy(policyName)
+	if err != nil {
+		log.Fatal(err)
 	}
+	nodePool.SetPolicy(policy)
+	ewmaHalfLife = halfLife
+	passiveConfig = PassiveHealthCheckConfig{
+		Window:                passiveWindowFlag,
+		FailureThreshold:      passiveFailures,
+		LatencyThreshold:      passiveLatency,
+		LatencyCountThreshold: passiveLatencyCount,
+		Cooldown:              passiveCooldown,
+	}
+	perNodeTransport = transportConfig{
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       maxConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		DialTimeout:           dialTimeout,
+		ResponseHeaderTimeout: responseHeaderTimeout,
+	}
+	circuitBreakerConfig = CircuitBreakerConfig{
+		Window:               breakerWindow,
+		MinRequests:          breakerMinRequests,
+		FailureRateThreshold: breakerFailureRate,
+		Cooldown:             breakerCooldown,
+	}
+	retryBudget = NewRetryBudget(retryBudgetRatio, retryBudgetMax)
 
-	for _, nodeURL := range strings.Split(nodeList, ",") {
-		nodeURLParsed, err := url.Parse(nodeURL)
-		if err != nil {
-			log.Fatal(err)
-		}
-		proxy := httputil.NewSingleHostReverseProxy(nodeURLParsed)
-		proxy.ErrorHandler = func(w http.ResponseWriter, request *http.Request, e error) {
-			log.Printf("[%s] %s\n", nodeURLParsed.Host, e.Error())
-			retries := GetRetryFromContext(request)
-			if retries < 3 {
-				select {
-				case <-time.After(10 * time.Millisecond):
-					ctx := context.WithValue(request.Context(), Retry, retries+1)
-					proxy.ServeHTTP(w, request.WithContext(ctx))
-				}
-				return
-			}
-
-			// Try diff node
-			attempts := GetAttemptsFromContext(request)
-			log.Printf("%s(%s) Attempting retry %d\n", request.RemoteAddr, request.URL.Path, attempts)
-			ctx := context.WithValue(request.Context(), Attempts, attempts+1)
-
-
-			// After 3 retries, set this node as dead
-			if attempts >= 3 {
-				nodePool.SetNodeStatus(nodeURLParsed, false)
-			}
-
-			loadBalancer(w, request.WithContext(ctx))
-
+	if stickyMode != "" {
+		if stickyMode == "cookie" && stickySecret == "" {
+			log.Fatal("-stickySecret is required for -sticky=cookie")
 		}
-		nodePool.AddNode(&Node{
-			URL:          nodeURLParsed,
-			Active:       true,
-			weight:       1,
-			ReverseProxy: proxy,
+		stickyRouter = NewStickyRouter(StickyConfig{
+			Mode:       stickyMode,
+			CookieName: stickyCookieName,
+			Secret:     []byte(stickySecret),
+			VNodes:     stickyVNodes,
 		})
+	}
 
-		log.Printf("Configured node: %s\n", nodeURLParsed)
+	source, err := buildUpstreamSource(upstreamSource, nodeList, dnsName, dnsPort, srvService, srvProto, srvName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	reconciler := NewUpstreamReconciler(&nodePool, source, buildNode, drainTimeout)
+	if stickyRouter != nil {
+		reconciler.OnChange = stickyRouter.RebuildRing
+	}
+	reconciler.reconcileOnce(ctx)
+	if len(nodePool.snapshot()) == 0 {
+		log.Fatal("No nodes discovered at startup")
+	}
+	if upstreamSource != "static" {
+		go reconciler.Run(ctx, upstreamRefresh, nil)
 	}
 
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lb/health", HealthHandler(&nodePool))
+	mux.HandleFunc("/", loadBalancer)
+
 	// Create LB server
 	server := http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(loadBalancer),
+		Handler: mux,
 	}
 
-	go healthCheck()
+	activeChecker, err := NewActiveHealthChecker(ActiveHealthCheckConfig{
+		Path:               healthPath,
+		Interval:           healthInterval,
+		Timeout:            healthTimeout,
+		ExpectedStatus:     expectedStatus,
+		ExpectedBody:       expectedBody,
+		HealthyThreshold:   healthyThreshold,
+		UnhealthyThreshold: unhealthyThreshold,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	go activeChecker.Run(&nodePool, nil)
+
+	var reloader *ConfigReloader
+	if configPath != "" {
+		reloader = &ConfigReloader{Path: configPath, Pool: &nodePool, Reconciler: reconciler}
+		if err := reloader.Reload(); err != nil {
+			log.Fatal(err)
+		}
+		go WatchConfigFile(configPath, configPollInterval, reloader.Reload, nil)
+	}
+
+	if adminPort != 0 {
+		admin := &AdminServer{
+			Pool:       &nodePool,
+			Reconciler: reconciler,
+			Reloader:   reloader,
+			NewNode:    buildNode,
+			DrainFor:   drainTimeout,
+		}
+		adminServer := http.Server{
+			Addr:    fmt.Sprintf(":%d", adminPort),
+			Handler: admin.Handler(),
+		}
+		go func() {
+			log.Printf("Admin API started on port: %d", adminPort)
+			if err := adminServer.ListenAndServe(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	log.Printf("Load Balancer started on port: %d", port)
+	log.Printf("Load Balancer started on port: %d (policy: %s, upstreamSource: %s)", port, policyName, upstreamSource)
 	if err := server.ListenAndServe(); err != nil {
 		log.Fatal(err)
 	}
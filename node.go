@@ -0,0 +1,222 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaHalfLife controls how quickly a node's latency EWMA forgets old
+// samples. It is configurable via the -ewmaHalfLife flag.
+var ewmaHalfLife = 10 * time.Second
+
+// Node holds the data about a backend server
+type Node struct {
+	URL           *url.URL
+	Active        bool
+	weight        float64
+	currentWeight float64
+	inflight      int64
+	ewma          float64
+	lastUpdate    time.Time
+	mutex         sync.RWMutex
+	ReverseProxy  *httputil.ReverseProxy
+
+	// health check bookkeeping
+	lastCheck            time.Time
+	consecutiveSuccesses int
+	consecutiveFailures  int
+	cooldownUntil        time.Time
+	passive              *passiveWindow
+	breaker              *CircuitBreaker
+	counts               map[int]int64
+}
+
+// recordRequest tallies one completed request by response status code (0
+// for a transport-level failure with no response), for /metrics
+func (n *Node) recordRequest(code int) {
+	n.mutex.Lock()
+	if n.counts == nil {
+		n.counts = make(map[int]int64)
+	}
+	n.counts[code]++
+	n.mutex.Unlock()
+}
+
+// requestCounts returns a copy of the node's per-status-code request tally
+func (n *Node) requestCounts() map[int]int64 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	counts := make(map[int]int64, len(n.counts))
+	for code, c := range n.counts {
+		counts[code] = c
+	}
+	return counts
+}
+
+// IsAvailable reports whether n should be considered for selection: it
+// must be active and, if it has a circuit breaker, not short-circuited
+func (n *Node) IsAvailable() bool {
+	return n.isActive() && (n.breaker == nil || n.breaker.Eligible())
+}
+
+// isActive returns whether node is active or dead
+func (n *Node) isActive() bool {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.Active
+}
+
+// getWeight returns the weight of the node
+func (n *Node) getWeight() float64 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.weight
+}
+
+// addCurrentWeight adds delta to the node's smooth-weighted-round-robin
+// current weight and returns the updated value
+func (n *Node) addCurrentWeight(delta float64) float64 {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.currentWeight += delta
+	return n.currentWeight
+}
+
+// getCurrentWeight returns the node's current weight
+func (n *Node) getCurrentWeight() float64 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.currentWeight
+}
+
+// decCurrentWeight subtracts delta from the node's current weight
+func (n *Node) decCurrentWeight(delta float64) {
+	n.mutex.Lock()
+	n.currentWeight -= delta
+	n.mutex.Unlock()
+}
+
+// inflightCount returns the number of in-flight requests for the node
+func (n *Node) inflightCount() int64 {
+	return atomic.LoadInt64(&n.inflight)
+}
+
+// getEWMA returns the node's exponentially weighted moving average latency, in seconds
+func (n *Node) getEWMA() float64 {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.ewma
+}
+
+// updateEWMA folds a new latency sample into the node's moving average,
+// decaying prior samples based on the time elapsed since the last update
+func (n *Node) updateEWMA(sample time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	if n.lastUpdate.IsZero() {
+		n.ewma = sample.Seconds()
+		n.lastUpdate = now
+		return
+	}
+
+	elapsed := now.Sub(n.lastUpdate).Seconds()
+	decay := math.Exp(-elapsed / ewmaHalfLife.Seconds())
+	n.ewma = n.ewma*decay + sample.Seconds()*(1-decay)
+	n.lastUpdate = now
+}
+
+// score is used by latency-aware policies: lower is better
+func (n *Node) score() float64 {
+	return n.getEWMA() * float64(n.inflightCount()+1)
+}
+
+// SetProps sets node's status
+func (n *Node) SetProps(status bool) {
+	n.mutex.Lock()
+	n.Active = status
+	if status {
+		n.currentWeight = 0
+	}
+	n.mutex.Unlock()
+}
+
+// recordActiveCheck folds the result of one active health probe into the
+// node's consecutive success/failure counters, flipping Active once the
+// configured threshold is crossed
+func (n *Node) recordActiveCheck(ok bool, healthyThreshold, unhealthyThreshold int) {
+	n.mutex.Lock()
+	n.lastCheck = time.Now()
+	if ok {
+		n.consecutiveSuccesses++
+		n.consecutiveFailures = 0
+		if !n.Active && n.consecutiveSuccesses >= healthyThreshold {
+			n.Active = true
+			n.currentWeight = 0
+		}
+	} else {
+		n.consecutiveFailures++
+		n.consecutiveSuccesses = 0
+		if n.Active && n.consecutiveFailures >= unhealthyThreshold {
+			n.Active = false
+		}
+	}
+	n.mutex.Unlock()
+}
+
+// scheduleCooldown marks the node unavailable for re-probing until d has
+// elapsed, used by the passive health checker
+func (n *Node) scheduleCooldown(d time.Duration) {
+	n.mutex.Lock()
+	n.cooldownUntil = time.Now().Add(d)
+	n.mutex.Unlock()
+}
+
+// getLastCheck returns the time of the node's last active health check
+func (n *Node) getLastCheck() time.Time {
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+	return n.lastCheck
+}
+
+// timingRoundTripper wraps a RoundTripper to gate requests on the owning
+// node's circuit breaker and to feed each outcome into the node's request
+// counts, latency EWMA, passive health window, breaker and the retry budget.
+// In-flight requests are counted by loadBalancer, not here.
+type timingRoundTripper struct {
+	node *Node
+	rt   http.RoundTripper
+}
+
+func (t *timingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.node.breaker != nil && !t.node.breaker.Claim() {
+		return nil, errCircuitOpen
+	}
+
+	start := time.Now()
+	resp, err := t.rt.RoundTrip(req)
+	latency := time.Since(start)
+	failed := err != nil || (resp != nil && resp.StatusCode >= 500)
+
+	code := 0
+	if resp != nil {
+		code = resp.StatusCode
+	}
+	t.node.recordRequest(code)
+
+	t.node.updateEWMA(latency)
+	t.node.RecordOutcome(failed, latency, passiveConfig)
+	if t.node.breaker != nil {
+		t.node.breaker.Record(failed)
+	}
+	if !failed && retryBudget != nil {
+		retryBudget.OnSuccess()
+	}
+	return resp, err
+}
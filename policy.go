@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// SelectionPolicy picks the next node to route a request to out of the
+// given active nodes. Implementations must be safe for concurrent use.
+type SelectionPolicy interface {
+	Name() string
+	NextNode(active []*Node) *Node
+}
+
+// NewSelectionPolicy builds the named policy, or an error if name is unknown
+func NewSelectionPolicy(name string) (SelectionPolicy, error) {
+	switch name {
+	case "round_robin", "":
+		return &RoundRobinPolicy{}, nil
+	case "weighted_rr":
+		return &WeightedRoundRobinPolicy{}, nil
+	case "least_conn":
+		return &LeastConnPolicy{}, nil
+	case "peak_ewma":
+		return &PeakEWMAPolicy{}, nil
+	case "random_two":
+		return &RandomTwoPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown selection policy: %q", name)
+	}
+}
+
+// RoundRobinPolicy cycles through active nodes in order
+type RoundRobinPolicy struct {
+	current uint64
+}
+
+func (p *RoundRobinPolicy) Name() string { return "round_robin" }
+
+func (p *RoundRobinPolicy) NextNode(active []*Node) *Node {
+	if len(active) == 0 {
+		return nil
+	}
+	idx := int(atomic.AddUint64(&p.current, 1) % uint64(len(active)))
+	return active[idx]
+}
+
+// WeightedRoundRobinPolicy implements smooth weighted round-robin: each
+// node's current weight is incremented by its configured weight every
+// pick, the highest current weight wins, and the winner's current weight
+// is reduced by the sum of all weights. This spreads picks proportionally
+// without the bursts a naive weighted round-robin produces.
+type WeightedRoundRobinPolicy struct{}
+
+func (p *WeightedRoundRobinPolicy) Name() string { return "weighted_rr" }
+
+func (p *WeightedRoundRobinPolicy) NextNode(active []*Node) *Node {
+	var total float64
+	var best *Node
+	var bestWeight float64
+
+	for _, n := range active {
+		w := n.getWeight()
+		total += w
+		cw := n.addCurrentWeight(w)
+		if best == nil || cw > bestWeight {
+			best = n
+			bestWeight = cw
+		}
+	}
+
+	if best != nil {
+		best.decCurrentWeight(total)
+	}
+	return best
+}
+
+// LeastConnPolicy picks the active node with the fewest in-flight requests
+type LeastConnPolicy struct{}
+
+func (p *LeastConnPolicy) Name() string { return "least_conn" }
+
+func (p *LeastConnPolicy) NextNode(active []*Node) *Node {
+	var best *Node
+	var bestCount int64
+	for _, n := range active {
+		c := n.inflightCount()
+		if best == nil || c < bestCount {
+			best = n
+			bestCount = c
+		}
+	}
+	return best
+}
+
+// PeakEWMAPolicy picks the active node with the lowest score, where score
+// is the node's latency EWMA weighted by its in-flight request count
+type PeakEWMAPolicy struct{}
+
+func (p *PeakEWMAPolicy) Name() string { return "peak_ewma" }
+
+func (p *PeakEWMAPolicy) NextNode(active []*Node) *Node {
+	var best *Node
+	var bestScore float64
+	for _, n := range active {
+		s := n.score()
+		if best == nil || s < bestScore {
+			best = n
+			bestScore = s
+		}
+	}
+	return best
+}
+
+// RandomTwoPolicy implements power-of-two-choices: sample two random active
+// nodes and pick the one with the lower EWMA/in-flight score. This gives
+// near-optimal balance without scanning every node on each request.
+type RandomTwoPolicy struct{}
+
+func (p *RandomTwoPolicy) Name() string { return "random_two" }
+
+func (p *RandomTwoPolicy) NextNode(active []*Node) *Node {
+	if len(active) == 0 {
+		return nil
+	}
+	if len(active) == 1 {
+		return active[0]
+	}
+
+	i := rand.Intn(len(active))
+	j := rand.Intn(len(active) - 1)
+	if j >= i {
+		j++
+	}
+
+	a, b := active[i], active[j]
+	if a.score() <= b.score() {
+		return a
+	}
+	return b
+}
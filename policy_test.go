@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func newTestNode(host string) *Node {
+	return &Node{URL: &url.URL{Scheme: "http", Host: host}, Active: true}
+}
+
+func TestUpdateEWMA_FirstSampleSetsValue(t *testing.T) {
+	n := newTestNode("a")
+	n.updateEWMA(100 * time.Millisecond)
+	if got := n.getEWMA(); got != 0.1 {
+		t.Fatalf("first sample: got ewma %v, want 0.1", got)
+	}
+}
+
+func TestUpdateEWMA_DecaysTowardNewSample(t *testing.T) {
+	ewmaHalfLife = 10 * time.Second
+	n := newTestNode("a")
+	n.updateEWMA(100 * time.Millisecond)
+	before := n.getEWMA()
+
+	time.Sleep(5 * time.Millisecond)
+	n.updateEWMA(500 * time.Millisecond)
+	after := n.getEWMA()
+
+	if !(after > before && after < 0.5) {
+		t.Fatalf("decayed ewma %v should land strictly between old sample %v and new sample 0.5", after, before)
+	}
+}
+
+func TestUpdateEWMA_LongHalfLifeBarelyMoves(t *testing.T) {
+	ewmaHalfLife = time.Hour
+	n := newTestNode("a")
+	n.updateEWMA(100 * time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	n.updateEWMA(10 * time.Second)
+
+	if got := n.getEWMA(); got > 0.11 {
+		t.Fatalf("a far-future half-life should barely move the average, got %v", got)
+	}
+}
+
+func TestRandomTwoPolicy_PicksLowerScore(t *testing.T) {
+	good := newTestNode("good")
+	good.ewma = 0.01
+	bad := newTestNode("bad")
+	bad.ewma = 1.0
+
+	p := &RandomTwoPolicy{}
+	for i := 0; i < 50; i++ {
+		if got := p.NextNode([]*Node{good, bad}); got != good {
+			t.Fatalf("expected the lower-scoring node to always win, got %v", got.URL.Host)
+		}
+	}
+}
+
+func TestRandomTwoPolicy_SingleNode(t *testing.T) {
+	only := newTestNode("only")
+	p := &RandomTwoPolicy{}
+	if got := p.NextNode([]*Node{only}); got != only {
+		t.Fatalf("single candidate should be returned as-is")
+	}
+}
+
+func TestRandomTwoPolicy_NoNodes(t *testing.T) {
+	p := &RandomTwoPolicy{}
+	if got := p.NextNode(nil); got != nil {
+		t.Fatalf("expected nil for no active nodes, got %v", got)
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+	"sync/atomic"
+)
+
+// NodePool holds the set of nodes and the policy used to pick between them.
+// Nodes are stored behind an atomic pointer so the hot request path (reads
+// via snapshot/ActiveNodes/NextNode) never blocks. mutex serializes writers
+// instead: AddNode, RemoveNode, Store and UpstreamReconciler.reconcile all
+// read-modify-write the same snapshot, and without a shared lock two
+// concurrent mutations (e.g. an admin call racing a reconcile tick) could
+// each read the same snapshot and have one silently clobber the other.
+type NodePool struct {
+	nodes  atomic.Pointer[[]*Node]
+	policy atomic.Pointer[SelectionPolicy]
+	mutex  sync.Mutex
+}
+
+// snapshot returns the current, immutable slice of nodes
+func (np *NodePool) snapshot() []*Node {
+	p := np.nodes.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
+
+// SetPolicy atomically replaces the pool's selection policy, used at
+// startup and by admin-triggered config reloads
+func (np *NodePool) SetPolicy(policy SelectionPolicy) {
+	np.policy.Store(&policy)
+}
+
+// Mutate serializes a read-modify-write against the pool's current node
+// snapshot: fn receives the current snapshot and returns the next one,
+// which is stored atomically before Mutate returns it. All writers
+// (AddNode, RemoveNode, Store, UpstreamReconciler.reconcile) go through
+// this so concurrent mutations can't race each other.
+func (np *NodePool) Mutate(fn func(current []*Node) []*Node) []*Node {
+	np.mutex.Lock()
+	defer np.mutex.Unlock()
+	next := fn(np.snapshot())
+	np.nodes.Store(&next)
+	return next
+}
+
+// AddNode adds a new node to the NodePool and returns the resulting snapshot
+func (np *NodePool) AddNode(n *Node) []*Node {
+	return np.Mutate(func(current []*Node) []*Node {
+		return append(append([]*Node{}, current...), n)
+	})
+}
+
+// RemoveNode removes the node with the given id (its nodeID) from the pool
+// and returns it (so the caller can drain it before discarding) along with
+// the resulting snapshot
+func (np *NodePool) RemoveNode(id string) (*Node, []*Node, bool) {
+	var removed *Node
+	next := np.Mutate(func(current []*Node) []*Node {
+		kept := make([]*Node, 0, len(current))
+		for _, n := range current {
+			if nodeID(n) == id {
+				removed = n
+				continue
+			}
+			kept = append(kept, n)
+		}
+		if removed == nil {
+			return current
+		}
+		return kept
+	})
+	return removed, next, removed != nil
+}
+
+// FindNode returns the node with the given id, if present
+func (np *NodePool) FindNode(id string) (*Node, bool) {
+	for _, n := range np.snapshot() {
+		if nodeID(n) == id {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Store atomically replaces the pool's nodes with a new snapshot, used by
+// the upstream reconciler
+func (np *NodePool) Store(nodes []*Node) {
+	np.Mutate(func([]*Node) []*Node { return nodes })
+}
+
+// ActiveNodes returns the nodes currently available for selection: marked
+// active and not short-circuited by their circuit breaker
+func (np *NodePool) ActiveNodes() []*Node {
+	nodes := np.snapshot()
+	active := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		if n.IsAvailable() {
+			active = append(active, n)
+		}
+	}
+	return active
+}
+
+// NextNode selects the next node to route a request to using the pool's
+// configured selection policy
+func (np *NodePool) NextNode() *Node {
+	p := np.policy.Load()
+	if p == nil {
+		return nil
+	}
+	return (*p).NextNode(np.ActiveNodes())
+}
+
+// SetNodeStatus sets the status of the given nodeURL
+func (np *NodePool) SetNodeStatus(url *url.URL, status bool) {
+	for _, n := range np.snapshot() {
+		if n.URL.String() == url.String() {
+			n.SetProps(status)
+			break
+		}
+	}
+}
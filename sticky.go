@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// StickyConfig configures session affinity
+type StickyConfig struct {
+	Mode       string // "cookie" or "ip_hash"
+	CookieName string
+	Secret     []byte
+	VNodes     int // virtual nodes per backend on the ip_hash ring
+}
+
+// StickyRouter pins clients to a backend, either via a signed cookie or a
+// consistent hash of the client's address. It falls back to the pool's
+// default policy whenever the pinned node is dead or no affinity exists yet.
+type StickyRouter struct {
+	Config StickyConfig
+	ring   atomic.Pointer[hashRing]
+}
+
+// NewStickyRouter builds a router from cfg, applying defaults for unset fields
+func NewStickyRouter(cfg StickyConfig) *StickyRouter {
+	if cfg.CookieName == "" {
+		cfg.CookieName = "LB_NODE"
+	}
+	if cfg.VNodes <= 0 {
+		cfg.VNodes = 160
+	}
+	return &StickyRouter{Config: cfg}
+}
+
+// Route returns the node r is pinned to, or nil if there is no pin (yet)
+// or the pinned node is no longer active
+func (s *StickyRouter) Route(r *http.Request) *Node {
+	switch s.Config.Mode {
+	case "cookie":
+		return s.routeCookie(r)
+	case "ip_hash":
+		return s.routeIPHash(r)
+	default:
+		return nil
+	}
+}
+
+func (s *StickyRouter) routeCookie(r *http.Request) *Node {
+	cookie, err := r.Cookie(s.Config.CookieName)
+	if err != nil {
+		return nil
+	}
+	id, ok := verifySignedID(cookie.Value, s.Config.Secret)
+	if !ok {
+		return nil
+	}
+	ring := s.ring.Load()
+	if ring == nil {
+		return nil
+	}
+	if n := ring.nodeByID(id); n != nil && n.IsAvailable() {
+		return n
+	}
+	return nil
+}
+
+func (s *StickyRouter) routeIPHash(r *http.Request) *Node {
+	ring := s.ring.Load()
+	if ring == nil {
+		return nil
+	}
+	return ring.get(clientKey(r))
+}
+
+// RebuildRing recomputes the consistent-hash ring from the current node
+// set. Call it whenever the pool's nodes change.
+func (s *StickyRouter) RebuildRing(nodes []*Node) {
+	s.ring.Store(newHashRing(nodes, s.Config.VNodes))
+}
+
+// TagResponse is installed as a node's ReverseProxy.ModifyResponse hook in
+// cookie mode, signing and setting the sticky cookie on every response so
+// the client's next request returns to the same node.
+func (s *StickyRouter) TagResponse(n *Node) func(*http.Response) error {
+	return func(resp *http.Response) error {
+		if s.Config.Mode != "cookie" {
+			return nil
+		}
+		cookie := &http.Cookie{
+			Name:  s.Config.CookieName,
+			Value: signID(nodeID(n), s.Config.Secret),
+			Path:  "/",
+		}
+		resp.Header.Add("Set-Cookie", cookie.String())
+		return nil
+	}
+}
+
+// nodeID is the stable identifier used to pin a client to a node
+func nodeID(n *Node) string {
+	return n.URL.String()
+}
+
+// clientKey extracts the address used to key ip_hash affinity, preferring
+// X-Forwarded-For (set by an upstream proxy) over RemoteAddr
+func clientKey(r *http.Request) string {
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		return strings.TrimSpace(strings.Split(xff, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// signID HMAC-signs id so clients can't forge their own node assignment
+func signID(id string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString([]byte(id)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedID checks value's signature and returns the embedded node id
+func verifySignedID(value string, secret []byte) (string, bool) {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	idBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	id := string(idBytes)
+	if !hmac.Equal([]byte(signID(id, secret)), []byte(value)) {
+		return "", false
+	}
+	return id, true
+}
+
+// ringEntry is one point on the consistent hash ring
+type ringEntry struct {
+	hash uint32
+	node *Node
+}
+
+// hashRing is a Ketama-style consistent hash ring with virtual nodes per
+// backend, so adding or removing a node only remaps ~1/N of keys.
+type hashRing struct {
+	entries []ringEntry
+	byID    map[string]*Node
+}
+
+func newHashRing(nodes []*Node, vnodes int) *hashRing {
+	hr := &hashRing{byID: make(map[string]*Node, len(nodes))}
+	for _, n := range nodes {
+		id := nodeID(n)
+		hr.byID[id] = n
+		for i := 0; i < vnodes; i++ {
+			label := id + "-" + strconv.Itoa(i)
+			hr.entries = append(hr.entries, ringEntry{hash: crc32.ChecksumIEEE([]byte(label)), node: n})
+		}
+	}
+	sort.Slice(hr.entries, func(i, j int) bool { return hr.entries[i].hash < hr.entries[j].hash })
+	return hr
+}
+
+func (hr *hashRing) nodeByID(id string) *Node {
+	return hr.byID[id]
+}
+
+// get walks the ring clockwise from key's hash and returns the first
+// active node it finds, so a dead node doesn't break affinity for every
+// key mapped to it
+func (hr *hashRing) get(key string) *Node {
+	if len(hr.entries) == 0 {
+		return nil
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(hr.entries), func(i int) bool { return hr.entries[i].hash >= h })
+
+	n := len(hr.entries)
+	for i := 0; i < n; i++ {
+		e := hr.entries[(start+i)%n]
+		if e.node.IsAvailable() {
+			return e.node
+		}
+	}
+	return nil
+}
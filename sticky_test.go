@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSignID_RoundTrip(t *testing.T) {
+	secret := []byte("super-secret")
+	signed := signID("http://10.0.0.1:8080", secret)
+
+	id, ok := verifySignedID(signed, secret)
+	if !ok || id != "http://10.0.0.1:8080" {
+		t.Fatalf("verifySignedID(signID(id)) = (%q, %v), want (%q, true)", id, ok, "http://10.0.0.1:8080")
+	}
+}
+
+func TestVerifySignedID_RejectsTamperedValue(t *testing.T) {
+	secret := []byte("super-secret")
+	signed := signID("http://10.0.0.1:8080", secret)
+	otherSig := signID("http://evil:8080", secret)
+
+	idPart := signed[:strings.Index(signed, ".")]
+	sigPart := otherSig[strings.Index(otherSig, ".")+1:]
+	tampered := idPart + "." + sigPart
+
+	if _, ok := verifySignedID(tampered, secret); ok {
+		t.Fatalf("a value with a signature for a different id must not verify")
+	}
+}
+
+func TestVerifySignedID_RejectsWrongSecret(t *testing.T) {
+	signed := signID("http://10.0.0.1:8080", []byte("secret-a"))
+	if _, ok := verifySignedID(signed, []byte("secret-b")); ok {
+		t.Fatalf("a value signed with a different secret must not verify")
+	}
+}
+
+func TestVerifySignedID_RejectsMalformedValue(t *testing.T) {
+	if _, ok := verifySignedID("not-a-valid-cookie-value", []byte("s")); ok {
+		t.Fatalf("a malformed cookie value must not verify")
+	}
+}
+
+func TestHashRing_GetIsStableAndSkipsInactiveNodes(t *testing.T) {
+	a := newTestNode("a")
+	b := newTestNode("b")
+	ring := newHashRing([]*Node{a, b}, 100)
+
+	key := "203.0.113.7"
+	picked := ring.get(key)
+	if picked == nil {
+		t.Fatalf("expected a node for key %q", key)
+	}
+	if got := ring.get(key); got != picked {
+		t.Fatalf("get(%q) must be stable across calls, got %v then %v", key, picked, got)
+	}
+
+	picked.Active = false
+	if got := ring.get(key); got == picked || got == nil {
+		t.Fatalf("get should skip the now-inactive node and fall through to another active one")
+	}
+}
+
+func TestHashRing_AddingNodeRemapsOnlyAFewKeys(t *testing.T) {
+	a := newTestNode("a")
+	b := newTestNode("b")
+	before := newHashRing([]*Node{a, b}, 100)
+
+	c := newTestNode("c")
+	after := newHashRing([]*Node{a, b, c}, 100)
+
+	const total = 1000
+	remapped := 0
+	for i := 0; i < total; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		if nodeID(before.get(key)) != nodeID(after.get(key)) {
+			remapped++
+		}
+	}
+
+	// Ketama-style consistent hashing should remap roughly 1/3 of keys when
+	// going from 2 to 3 nodes, nowhere near a full rehash.
+	if remapped > total/2 {
+		t.Fatalf("adding a node remapped %d/%d keys, expected well under half", remapped, total)
+	}
+}
+
+func TestHashRing_EmptyRing(t *testing.T) {
+	ring := newHashRing(nil, 100)
+	if got := ring.get("anything"); got != nil {
+		t.Fatalf("expected nil from an empty ring, got %v", got)
+	}
+}
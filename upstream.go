@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UpstreamTarget is one backend discovered by an UpstreamSource
+type UpstreamTarget struct {
+	URL    *url.URL
+	Weight float64
+}
+
+// UpstreamSource resolves the current set of backends the pool should
+// route to. Implementations are polled on an interval by UpstreamReconciler.
+type UpstreamSource interface {
+	Name() string
+	Resolve(ctx context.Context) ([]UpstreamTarget, error)
+}
+
+// StaticSource returns a fixed, unchanging list of targets
+type StaticSource struct {
+	Targets []UpstreamTarget
+}
+
+func (s *StaticSource) Name() string { return "static" }
+
+func (s *StaticSource) Resolve(ctx context.Context) ([]UpstreamTarget, error) {
+	return s.Targets, nil
+}
+
+// DNSSource discovers backends by resolving a hostname's A/AAAA records
+type DNSSource struct {
+	Host     string
+	Port     int
+	Scheme   string
+	Resolver *net.Resolver
+}
+
+func (s *DNSSource) Name() string { return "dns" }
+
+func (s *DNSSource) Resolve(ctx context.Context) ([]UpstreamTarget, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	addrs, err := resolver.LookupIPAddr(ctx, s.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dns: resolve %s: %w", s.Host, err)
+	}
+
+	targets := make([]UpstreamTarget, 0, len(addrs))
+	for _, addr := range addrs {
+		u := &url.URL{
+			Scheme: s.Scheme,
+			Host:   net.JoinHostPort(addr.IP.String(), strconv.Itoa(s.Port)),
+		}
+		targets = append(targets, UpstreamTarget{URL: u, Weight: 1})
+	}
+	return targets, nil
+}
+
+// SRVSource discovers backends and their relative weights via SRV records,
+// honoring priority by keeping only the lowest-priority (highest preference) group
+type SRVSource struct {
+	Service  string
+	Proto    string
+	Domain   string
+	Scheme   string
+	Resolver *net.Resolver
+}
+
+func (s *SRVSource) Name() string { return "srv" }
+
+func (s *SRVSource) Resolve(ctx context.Context) ([]UpstreamTarget, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, s.Service, s.Proto, s.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("srv: resolve %s: %w", s.Domain, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	best := records[0].Priority
+	for _, r := range records {
+		if r.Priority < best {
+			best = r.Priority
+		}
+	}
+
+	targets := make([]UpstreamTarget, 0, len(records))
+	for _, r := range records {
+		if r.Priority != best {
+			continue
+		}
+		host := strings.TrimSuffix(r.Target, ".")
+		u := &url.URL{
+			Scheme: s.Scheme,
+			Host:   net.JoinHostPort(host, strconv.Itoa(int(r.Port))),
+		}
+		weight := float64(r.Weight)
+		if weight <= 0 {
+			weight = 1
+		}
+		targets = append(targets, UpstreamTarget{URL: u, Weight: weight})
+	}
+	return targets, nil
+}
+
+// UpstreamReconciler polls an UpstreamSource and reconciles the NodePool to
+// match, reusing existing Node objects (and their health/weight/ewma state)
+// for targets that are still present, and draining ones that vanished.
+type UpstreamReconciler struct {
+	Pool     *NodePool
+	Source   UpstreamSource
+	NewNode  func(target UpstreamTarget) *Node
+	OnChange func(nodes []*Node) // optional, called after every reconcile
+	drainFor time.Duration
+}
+
+// NewUpstreamReconciler builds a reconciler; drainFor bounds how long a
+// removed node's ReverseProxy is kept alive to let in-flight requests finish
+func NewUpstreamReconciler(pool *NodePool, source UpstreamSource, newNode func(UpstreamTarget) *Node, drainFor time.Duration) *UpstreamReconciler {
+	return &UpstreamReconciler{Pool: pool, Source: source, NewNode: newNode, drainFor: drainFor}
+}
+
+// Run re-resolves the source every interval until stopped. Callers should
+// do an initial reconcileOnce synchronously before starting Run in the
+// background, so the pool is populated before serving traffic.
+func (r *UpstreamReconciler) Run(ctx context.Context, interval time.Duration, stop <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			r.reconcileOnce(ctx)
+		}
+	}
+}
+
+// ReconcileTargets reconciles the pool against an explicit target list,
+// bypassing r.Source. Used by admin-triggered config reloads.
+func (r *UpstreamReconciler) ReconcileTargets(targets []UpstreamTarget) {
+	r.reconcile(targets)
+}
+
+func (r *UpstreamReconciler) reconcileOnce(ctx context.Context) {
+	targets, err := r.Source.Resolve(ctx)
+	if err != nil {
+		log.Printf("upstream(%s): %v", r.Source.Name(), err)
+		return
+	}
+	r.reconcile(targets)
+}
+
+// reconcile swaps the pool's node snapshot for one matching targets,
+// keeping existing nodes (and their live state) where the URL is unchanged
+// and draining nodes whose target disappeared. The whole diff runs inside
+// Pool.Mutate so it can't race a concurrent admin mutation or another
+// reconcile tick and silently clobber it.
+func (r *UpstreamReconciler) reconcile(targets []UpstreamTarget) {
+	var added []string
+	var removed []*Node
+
+	next := r.Pool.Mutate(func(current []*Node) []*Node {
+		added = nil
+		removed = nil
+
+		existing := make(map[string]*Node, len(current))
+		for _, n := range current {
+			existing[n.URL.String()] = n
+		}
+
+		seen := make(map[string]bool, len(targets))
+		next := make([]*Node, 0, len(targets))
+		for _, target := range targets {
+			key := target.URL.String()
+			seen[key] = true
+			if n, ok := existing[key]; ok {
+				n.mutex.Lock()
+				n.weight = target.Weight
+				n.mutex.Unlock()
+				next = append(next, n)
+				continue
+			}
+			n := r.NewNode(target)
+			next = append(next, n)
+			added = append(added, key)
+		}
+
+		for key, n := range existing {
+			if !seen[key] {
+				removed = append(removed, n)
+			}
+		}
+		return next
+	})
+
+	for _, key := range added {
+		log.Printf("upstream(%s): added node %s", r.Source.Name(), key)
+	}
+	for _, n := range removed {
+		log.Printf("upstream(%s): removing node %s, draining", r.Source.Name(), n.URL.String())
+		go r.drain(n)
+	}
+
+	if r.OnChange != nil {
+		r.OnChange(next)
+	}
+}
+
+// drain marks a removed node inactive so it stops receiving new requests,
+// waits for its in-flight requests to finish (bounded by drainFor), then
+// releases its idle connections so the ReverseProxy can be garbage collected
+func (r *UpstreamReconciler) drain(n *Node) {
+	drainNode(n, r.drainFor)
+}